@@ -1,9 +1,8 @@
 package client
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"sync"
 
 	"github.com/machinebox/graphql"
 )
@@ -14,9 +13,18 @@ type ChatPlugClient struct {
 	MessagesChan          chan *MessageReceived
 	ConfigurationRecvChan chan *ConfigurationResponse
 	SearchRequestsChan    chan *SearchRequest
-	msgSubID              string
-	cfgSubID              string
-	searchSubID           string
+
+	// AutoInitialize, when true (the default), reports INSTANCE_STATUS
+	// INITIALIZING once Connect dials and INITIALIZED once the first
+	// configuration response is received via SubscribeToConfigResponses.
+	AutoInitialize bool
+
+	// OnStateChange, if set, is called whenever SetInstanceStatus changes
+	// the instance's reported status.
+	OnStateChange func(old, new InstanceStatus)
+
+	statusMu sync.Mutex
+	status   InstanceStatus
 }
 
 func NewChatPlugClient(wsURL string, httpUrl string, accessToken string) *ChatPlugClient {
@@ -25,100 +33,166 @@ func NewChatPlugClient(wsURL string, httpUrl string, accessToken string) *ChatPl
 		MessagesChan:          make(chan *MessageReceived),
 		ConfigurationRecvChan: make(chan *ConfigurationResponse),
 		SearchRequestsChan:    make(chan *SearchRequest),
-		msgSubID:              "",
-		cfgSubID:              "",
-		searchSubID:           "",
+		AutoInitialize:        true,
 	}
 }
 
 func (cpc *ChatPlugClient) Close() {
-	_ = cpc.GQLClient.wsConn.Close()
+	if cpc.GQLClient.cancel != nil {
+		cpc.GQLClient.cancel()
+	}
+	_ = cpc.GQLClient.closeConn()
 }
 
-// SendMessage sends a message with given data to core server via graphql
-func (cpc *ChatPlugClient) SendMessage(body string, originId string, originThreadId string, username string, authorOriginId string, authorAvatarUrl string, attachments []*AttachmentInput) {
+// SendMessageInput mirrors the variables of the sendMessage mutation.
+type SendMessageInput struct {
+	Body            string
+	OriginID        string
+	OriginThreadID  string
+	Username        string
+	AuthorOriginID  string
+	AuthorAvatarURL string
+	Attachments     []*AttachmentInput
+}
+
+type sendMessagePayload struct {
+	SendMessage Message `json:"sendMessage"`
+}
+
+// SendMessage sends a message with given data to the core server via graphql
+func (cpc *ChatPlugClient) SendMessage(ctx context.Context, input SendMessageInput) (*Message, error) {
 	req := graphql.NewRequest(sendMessageMutation)
-	req.Var("body", body)
-	req.Var("originId", originId)
-	req.Var("originThreadId", originThreadId)
-	req.Var("username", username)
-	req.Var("authorOriginId", authorOriginId)
-	req.Var("authorAvatarUrl", authorAvatarUrl)
-	req.Var("attachments", attachments)
-
-	fmt.Println("Sending sendMessage mutation to the core")
-	_, err := cpc.GQLClient.Request(req)
-	if err != nil {
-		fmt.Println("error occured")
-		fmt.Println(err)
+	req.Var("body", input.Body)
+	req.Var("originId", input.OriginID)
+	req.Var("originThreadId", input.OriginThreadID)
+	req.Var("username", input.Username)
+	req.Var("authorOriginId", input.AuthorOriginID)
+	req.Var("authorAvatarUrl", input.AuthorAvatarURL)
+	req.Var("attachments", input.Attachments)
+
+	var resp sendMessagePayload
+	if err := cpc.GQLClient.RequestInto(ctx, req, &resp); err != nil {
+		return nil, err
 	}
+	return &resp.SendMessage, nil
+}
+
+// SetSearchResponseInput mirrors the variables of the setSearchResponse mutation.
+type SetSearchResponseInput struct {
+	ForQuery string
+	Threads  []*SearchThreadInput
+}
+
+type setSearchResponsePayload struct {
+	SetSearchResponse struct {
+		ForQuery string   `json:"forQuery"`
+		Threads  []Thread `json:"threads"`
+	} `json:"setSearchResponse"`
 }
 
 // SetSearchResponse sets a response to a given search query
-func (cpc *ChatPlugClient) SetSearchResponse(forQuery string, threads []*SearchThreadInput) {
+func (cpc *ChatPlugClient) SetSearchResponse(ctx context.Context, input SetSearchResponseInput) error {
 	req := graphql.NewRequest(setSearchResultMutation)
-	req.Var("q", forQuery)
-	req.Var("res", threads)
-
-	fmt.Println("Sending sendMessage mutation to the core")
-	_, err := cpc.GQLClient.Request(req)
-	if err != nil {
-		fmt.Println("error occured")
-		fmt.Println(err)
-	}
+	req.Var("q", input.ForQuery)
+	req.Var("res", input.Threads)
+
+	var resp setSearchResponsePayload
+	return cpc.GQLClient.RequestInto(ctx, req, &resp)
 }
 
-// SubscribeToNewMessages starts a subscription to core server's messages
-func (cpc *ChatPlugClient) SubscribeToNewMessages() {
-	cpc.msgSubID = cpc.GQLClient.Subscribe(messageReceivedSubscription, map[string]interface{}{})
+type setInstanceStatusPayload struct {
+	SetInstanceStatus struct {
+		Status string `json:"status"`
+		Name   string `json:"name"`
+	} `json:"setInstanceStatus"`
 }
 
-// SubscribeToNewMessages starts a subscription to thread search requests
-func (cpc *ChatPlugClient) SubscribeToSearchRequests() {
-	cpc.searchSubID = cpc.GQLClient.Subscribe(searchRequestSubscription, map[string]interface{}{})
+// SetInstanceStatus reports the service instance's lifecycle status to the
+// core server and fires OnStateChange if the status actually changed.
+func (cpc *ChatPlugClient) SetInstanceStatus(ctx context.Context, status InstanceStatus) error {
+	req := graphql.NewRequest(setInstanceStatusMutation)
+	req.Var("status", status)
+
+	var resp setInstanceStatusPayload
+	if err := cpc.GQLClient.RequestInto(ctx, req, &resp); err != nil {
+		return err
+	}
+
+	cpc.statusMu.Lock()
+	old := cpc.status
+	cpc.status = status
+	cpc.statusMu.Unlock()
+
+	if old != status && cpc.OnStateChange != nil {
+		cpc.OnStateChange(old, status)
+	}
+	return nil
+}
+
+// SubscribeToNewMessages starts a subscription to core server's messages,
+// forwarding decoded messages to MessagesChan until unsubscribed.
+func (cpc *ChatPlugClient) SubscribeToNewMessages() func() error {
+	msgs, unsubscribe := Subscribe[messageReceivedPayload](cpc.GQLClient, messageReceivedSubscription, map[string]interface{}{})
+	go func() {
+		for msg := range msgs {
+			cpc.MessagesChan <- &msg.Data.MessageReceived
+		}
+	}()
+	return unsubscribe
 }
 
-func (cpc *ChatPlugClient) Connect() {
-	packets, _ := cpc.GQLClient.Connect()
+// SubscribeToSearchRequests starts a subscription to thread search requests,
+// forwarding decoded requests to SearchRequestsChan until unsubscribed.
+func (cpc *ChatPlugClient) SubscribeToSearchRequests() func() error {
+	reqs, unsubscribe := Subscribe[searchRequestPayload](cpc.GQLClient, searchRequestSubscription, map[string]interface{}{})
+	go func() {
+		for req := range reqs {
+			cpc.SearchRequestsChan <- &req.Data.SubscribeToSearchRequests
+		}
+	}()
+	return unsubscribe
+}
 
+// SubscribeToConfigResponses starts a subscription to configuration
+// responses matching the given schema, forwarding decoded responses to
+// ConfigurationRecvChan until unsubscribed. If AutoInitialize is set, the
+// first configuration response reports InstanceStatusInitialized.
+func (cpc *ChatPlugClient) SubscribeToConfigResponses(ctx context.Context, configurationSchema []ConfigurationField) func() error {
+	variables := map[string]interface{}{"fields": configurationSchema}
+	cfgs, unsubscribe := Subscribe[configurationReceivedPayload](cpc.GQLClient, requestConfigurationRequest, variables)
+	var reportInitialized sync.Once
 	go func() {
-		for packet := range packets {
-			log.Println(packet.Type)
-			log.Println(packet.ID)
-			log.Println(cpc.cfgSubID)
-
-			if packet.Type == "data" {
-				if packet.ID == cpc.msgSubID {
-					var msg messageReceivedPayload
-					err := json.Unmarshal(*packet.Payload, &msg)
-					if err != nil {
-						fmt.Printf(err.Error())
-					}
-					cpc.MessagesChan <- &msg.Data.MessageReceived
-				}
-				if packet.ID == cpc.cfgSubID {
-					var cfg configurationReceivedPayload
-					err := json.Unmarshal(*packet.Payload, &cfg)
-					if err != nil {
-						fmt.Printf(err.Error())
-					}
-					cpc.ConfigurationRecvChan <- &cfg.Data.ConfigurationReceived
-				}
-				if packet.ID == cpc.searchSubID {
-					var req searchRequestPayload
-					err := json.Unmarshal(*packet.Payload, &req)
-					if err != nil {
-						fmt.Printf(err.Error())
-					}
-					cpc.SearchRequestsChan <- &req.Data.SubscribeToSearchRequests
-				}
+		for cfg := range cfgs {
+			cpc.ConfigurationRecvChan <- &cfg.Data.ConfigurationReceived
+			if cpc.AutoInitialize {
+				reportInitialized.Do(func() {
+					go func() {
+						if err := cpc.SetInstanceStatus(ctx, InstanceStatusInitialized); err != nil {
+							cpc.GQLClient.Logger.Printf("chatplugclient: failed to report %s status: %v", InstanceStatusInitialized, err)
+						}
+					}()
+				})
 			}
 		}
 	}()
+	return unsubscribe
 }
 
-func (cpc *ChatPlugClient) SubscribeToConfigResponses(configurationSchema []ConfigurationField) {
-	variables := make(map[string]interface{})
-	variables["fields"] = configurationSchema
-	cpc.cfgSubID = cpc.GQLClient.Subscribe(requestConfigurationRequest, variables)
+// Connect dials the core server and keeps the connection alive until ctx is
+// cancelled, transparently reconnecting and replaying subscriptions
+// registered via SubscribeToNewMessages/SubscribeToSearchRequests/
+// SubscribeToConfigResponses on transient drops. If AutoInitialize is set,
+// it also reports InstanceStatusInitializing.
+func (cpc *ChatPlugClient) Connect(ctx context.Context) <-chan error {
+	errChan := cpc.GQLClient.Connect(ctx)
+
+	if cpc.AutoInitialize {
+		go func() {
+			if err := cpc.SetInstanceStatus(ctx, InstanceStatusInitializing); err != nil {
+				cpc.GQLClient.Logger.Printf("chatplugclient: failed to report %s status: %v", InstanceStatusInitializing, err)
+			}
+		}()
+	}
+
+	return errChan
 }
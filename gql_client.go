@@ -5,15 +5,40 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	mrand "math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/machinebox/graphql"
 )
 
+// Protocol identifies which GraphQL-over-WebSocket subprotocol a GQLClient speaks.
+type Protocol string
+
 const (
-	connectionInitMsg   = "connection_init" // Client -> Server
-	startMsg            = "start"           // Client -> Server
+	// GraphQLWS is the legacy apollographql/subscriptions-transport-ws protocol.
+	GraphQLWS Protocol = "graphql-ws"
+	// GraphQLTransportWS is the newer enisdenjo/graphql-ws protocol.
+	GraphQLTransportWS Protocol = "graphql-transport-ws"
+)
+
+const (
+	connectionInitMsg = "connection_init" // Client -> Server
+	connectionAckMsg  = "connection_ack"  // Server -> Client
+	startMsg          = "start"           // Client -> Server, graphql-ws subscribe
+	subscribeMsg      = "subscribe"       // Client -> Server, graphql-transport-ws subscribe
+	dataMsg           = "data"            // Server -> Client, graphql-ws payload
+	nextMsg           = "next"            // Server -> Client, graphql-transport-ws payload
+	stopMsg           = "stop"            // Client -> Server, graphql-ws unsubscribe
+	completeMsg       = "complete"        // Both protocols, terminates a subscription
+	errorMsg          = "error"
+	kaMsg             = "ka"   // Server -> Client, graphql-ws keepalive
+	pingMsg           = "ping" // Both directions, graphql-transport-ws keepalive
+	pongMsg           = "pong"
+
 	sendMessageMutation = `
 	mutation sendMessage($body: String!, $originId: String!, $originThreadId: String!, $username: String!, $authorOriginId: String!, $authorAvatarUrl: String!, $attachments: [AttachmentInput!]!) {
 		sendMessage(
@@ -85,14 +110,24 @@ const (
 	  }`
 
 	setInstanceStatusMutation = `
-	mutation {
-		setInstanceStatus(status:INITIALIZED) {
+	mutation setInstanceStatus($status: InstanceStatus!) {
+		setInstanceStatus(status:$status) {
 		  status
 		  name
 		}
 	  }`
 )
 
+// InstanceStatus is the lifecycle status a service instance reports to the core server.
+type InstanceStatus string
+
+const (
+	InstanceStatusInitializing InstanceStatus = "INITIALIZING"
+	InstanceStatusInitialized  InstanceStatus = "INITIALIZED"
+	InstanceStatusError        InstanceStatus = "ERROR"
+	InstanceStatusShuttingDown InstanceStatus = "SHUTTING_DOWN"
+)
+
 // MessageAuthor holds information about single message's atuhor
 type MessageAuthor struct {
 	ID        string `json:"id"`
@@ -201,96 +236,478 @@ type PayloadMessage struct {
 }
 
 type GQLClient struct {
-	WSUrl   string
-	HTTPUrl string
-	Headers PayloadMessage
-	client  *graphql.Client
-
+	WSUrl    string
+	HTTPUrl  string
+	Headers  PayloadMessage
+	Protocol Protocol
+	client   *graphql.Client
+
+	// MinBackoff and MaxBackoff bound the exponential backoff used between
+	// reconnection attempts. KeepaliveInterval controls how often a ping is
+	// sent on an established connection; zero disables it.
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	KeepaliveInterval time.Duration
+
+	// StateChan reports connection lifecycle transitions. Buffered; sends are non-blocking.
+	StateChan chan ConnectionState
+
+	// Logger receives diagnostic output instead of the package logging to
+	// stdout directly. Defaults to a no-op logger.
+	Logger Logger
+
+	connMu sync.Mutex
 	wsConn *websocket.Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	subsMu sync.Mutex
+	subs   map[string]*subscription
 }
 
+// NewGQLClient creates a GQLClient that speaks the graphql-ws protocol. Use
+// NewGQLClientWithProtocol to pick GraphQLTransportWS instead.
 func NewGQLClient(wsUrl string, httpUrl string, headers PayloadMessage) *GQLClient {
+	return NewGQLClientWithProtocol(wsUrl, httpUrl, headers, GraphQLWS)
+}
+
+// NewGQLClientWithProtocol creates a GQLClient speaking the given subscription protocol.
+func NewGQLClientWithProtocol(wsUrl string, httpUrl string, headers PayloadMessage, protocol Protocol) *GQLClient {
 	return &GQLClient{
-		WSUrl:   wsUrl,
-		HTTPUrl: httpUrl,
-		Headers: headers,
-		client:  graphql.NewClient(httpUrl),
+		WSUrl:             wsUrl,
+		HTTPUrl:           httpUrl,
+		Headers:           headers,
+		Protocol:          protocol,
+		client:            graphql.NewClient(httpUrl),
+		MinBackoff:        time.Second,
+		MaxBackoff:        30 * time.Second,
+		KeepaliveInterval: 30 * time.Second,
+		StateChan:         make(chan ConnectionState, 8),
+		Logger:            noopLogger{},
+		subs:              make(map[string]*subscription),
+	}
+}
+
+// protocol returns the configured subscription protocol, defaulting to the
+// legacy GraphQLWS when the Protocol field is left unset.
+func (gqc *GQLClient) protocol() Protocol {
+	if gqc.Protocol == "" {
+		return GraphQLWS
+	}
+	return gqc.Protocol
+}
+
+// subscribeMsgType returns the client->server message type used to start a subscription.
+func (gqc *GQLClient) subscribeMsgType() string {
+	if gqc.protocol() == GraphQLTransportWS {
+		return subscribeMsg
+	}
+	return startMsg
+}
+
+// isDataMsg reports whether a server->client message type carries subscription payload.
+func isDataMsg(t string) bool {
+	return t == dataMsg || t == nextMsg
+}
+
+// ConnectionState describes the lifecycle of a GQLClient's websocket connection.
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+// subscription is everything needed to replay a Subscribe call on a fresh
+// connection and to demultiplex its frames to the caller that registered it.
+type subscription struct {
+	query string
+	vars  map[string]interface{}
+	out   chan json.RawMessage
+
+	// closeMu guards out's closed state so send and close can't race each other.
+	closeMu sync.Mutex
+	closed  bool
+}
+
+// send delivers payload on out, unless already closed or ctx is done first.
+func (s *subscription) send(ctx context.Context, payload json.RawMessage) bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.out <- payload:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
+func (s *subscription) close() {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.out)
+}
+
+// Logger lets library consumers route GQLClient's diagnostic output elsewhere. Defaults to a no-op.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Printf(string, ...interface{}) {}
+
+// GraphQLError wraps the error array a subscription "error" frame carries.
+type GraphQLError struct {
+	SubID  string
+	Errors []*ErrorMessage
+}
+
+func (e *GraphQLError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("graphql: subscription %s errored", e.SubID)
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, m := range e.Errors {
+		msgs[i] = m.Message
+	}
+	return fmt.Sprintf("graphql: subscription %s: %s", e.SubID, strings.Join(msgs, "; "))
+}
+
 // Request sends a graphql requests to the core server and returns a pointer to map with result
-func (gqc *GQLClient) Request(req *graphql.Request) (*map[string]interface{}, error) {
-	// make a request
-	req.Header.Add("Authentication", gqc.Headers.AccessToken)
-	ctx := context.Background()
+func (gqc *GQLClient) Request(ctx context.Context, req *graphql.Request) (*map[string]interface{}, error) {
 	var respData map[string]interface{}
-
-	if err := gqc.client.Run(ctx, req, &respData); err != nil {
+	if err := gqc.RequestInto(ctx, req, &respData); err != nil {
 		return nil, err
 	}
 	return &respData, nil
 }
 
+// RequestInto sends a graphql request to the core server and decodes its response into resp.
+func (gqc *GQLClient) RequestInto(ctx context.Context, req *graphql.Request, resp interface{}) error {
+	req.Header.Add("Authentication", gqc.Headers.AccessToken)
+	return gqc.client.Run(ctx, req, resp)
+}
+
+// conn returns the current websocket connection, guarded by connMu.
+func (gqc *GQLClient) conn() *websocket.Conn {
+	gqc.connMu.Lock()
+	defer gqc.connMu.Unlock()
+	return gqc.wsConn
+}
+
+func (gqc *GQLClient) setConn(ws *websocket.Conn) {
+	gqc.connMu.Lock()
+	gqc.wsConn = ws
+	gqc.connMu.Unlock()
+}
+
+// closeConn closes the current websocket connection, if any.
+func (gqc *GQLClient) closeConn() error {
+	if conn := gqc.conn(); conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
 func (gqc *GQLClient) ReadIncomingPayload() (*IncomingPayload, error) {
 	var msg IncomingPayload
-	err := gqc.wsConn.ReadJSON(&msg)
-	if err != nil {
-		panic(err)
-	}
+	err := gqc.conn().ReadJSON(&msg)
 	return &msg, err
 }
 
-func (gqc *GQLClient) WriteOperationPacket(packet *OperationMessage) {
-	_ = gqc.wsConn.WriteJSON(packet)
+func (gqc *GQLClient) WriteOperationPacket(packet *OperationMessage) error {
+	return gqc.conn().WriteJSON(packet)
 }
 
-func (gqc *GQLClient) Subscribe(query string, variables map[string]interface{}) string {
-	subID := GenerateID()
-	gqc.WriteOperationPacket(&OperationMessage{Type: startMsg, ID: subID, Payload: PayloadMessage{
+func (gqc *GQLClient) writeSubscribe(subID string, query string, variables map[string]interface{}) {
+	_ = gqc.WriteOperationPacket(&OperationMessage{Type: gqc.subscribeMsgType(), ID: subID, Payload: PayloadMessage{
 		Query:     query,
 		Variables: variables,
 	}})
+}
 
-	return subID
+// unsubscribeMsgType returns the client->server message type that ends a subscription.
+func (gqc *GQLClient) unsubscribeMsgType() string {
+	if gqc.protocol() == GraphQLTransportWS {
+		return completeMsg
+	}
+	return stopMsg
 }
 
-func (gqc *GQLClient) Connect() (<-chan *IncomingPayload, <-chan error) {
+// Subscribe starts a subscription carrying T-shaped payloads, remembered so
+// it can be replayed on reconnect, and returns a channel of decoded values
+// plus an unsubscribe func.
+func Subscribe[T any](gqc *GQLClient, query string, variables map[string]interface{}) (<-chan T, func() error) {
+	subID := GenerateID()
+	raw := make(chan json.RawMessage)
+
+	gqc.subsMu.Lock()
+	gqc.subs[subID] = &subscription{query: query, vars: variables, out: raw}
+	gqc.subsMu.Unlock()
+
+	gqc.writeSubscribe(subID, query, variables)
+
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for payload := range raw {
+			var v T
+			if err := json.Unmarshal(payload, &v); err != nil {
+				gqc.Logger.Printf("gqlclient: failed to decode subscription %s: %v", subID, err)
+				continue
+			}
+			out <- v
+		}
+	}()
+
+	unsubscribe := func() error {
+		gqc.subsMu.Lock()
+		sub, ok := gqc.subs[subID]
+		delete(gqc.subs, subID)
+		gqc.subsMu.Unlock()
+		if ok {
+			sub.close()
+		}
+		return gqc.WriteOperationPacket(&OperationMessage{Type: gqc.unsubscribeMsgType(), ID: subID})
+	}
+
+	return out, unsubscribe
+}
+
+// demux routes subscription payloads to the channel registered for their ID.
+func (gqc *GQLClient) demux(packets <-chan *IncomingPayload) {
+	defer gqc.closeSubscriptions()
+
+	for packet := range packets {
+		if !isDataMsg(packet.Type) || packet.Payload == nil {
+			continue
+		}
+
+		gqc.subsMu.Lock()
+		sub, ok := gqc.subs[packet.ID]
+		gqc.subsMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if !sub.send(gqc.ctx, *packet.Payload) && gqc.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// closeSubscriptions closes every still-registered subscription's channel so
+// its decode goroutine can exit instead of leaking.
+func (gqc *GQLClient) closeSubscriptions() {
+	gqc.subsMu.Lock()
+	subs := gqc.subs
+	gqc.subs = make(map[string]*subscription)
+	gqc.subsMu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+func (gqc *GQLClient) replaySubscriptions() {
+	gqc.subsMu.Lock()
+	defer gqc.subsMu.Unlock()
+	for subID, sub := range gqc.subs {
+		gqc.writeSubscribe(subID, sub.query, sub.vars)
+	}
+}
+
+func (gqc *GQLClient) setState(s ConnectionState) {
+	select {
+	case gqc.StateChan <- s:
+	default:
+	}
+}
+
+// postErr reports err on errChan without blocking if nobody is reading it.
+func (gqc *GQLClient) postErr(errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	default:
+		gqc.Logger.Printf("gqlclient: dropping error, errChan is not being drained: %v", err)
+	}
+}
+
+func (gqc *GQLClient) dial() error {
 	headers := make(http.Header)
-	headers.Add("Sec-Websocket-Protocol", "graphql-ws")
+	headers.Add("Sec-Websocket-Protocol", string(gqc.protocol()))
 	ws, _, err := websocket.DefaultDialer.Dial(gqc.WSUrl, headers)
-
 	if err != nil {
-		panic(err)
+		return err
 	}
-	gqc.wsConn = ws
-	channel := make(chan *IncomingPayload)
-	errChan := make(chan error)
+	gqc.setConn(ws)
+
+	_ = gqc.WriteOperationPacket(&OperationMessage{Type: connectionInitMsg, Payload: gqc.Headers})
+	_, err = gqc.ReadIncomingPayload()
+	return err
+}
+
+// sleepBackoff waits out the current backoff (plus jitter) and doubles it for
+// next time, capped at MaxBackoff. It returns false if ctx was cancelled
+// while waiting.
+func (gqc *GQLClient) sleepBackoff(backoff *time.Duration) bool {
+	jitter := time.Duration(mrand.Int63n(int64(*backoff)/2 + 1))
+	wait := *backoff + jitter
 
-	gqc.WriteOperationPacket(&OperationMessage{Type: connectionInitMsg, Payload: gqc.Headers})
-	_, _ = gqc.ReadIncomingPayload()
+	*backoff *= 2
+	if *backoff > gqc.MaxBackoff {
+		*backoff = gqc.MaxBackoff
+	}
 
+	select {
+	case <-time.After(wait):
+		return true
+	case <-gqc.ctx.Done():
+		return false
+	}
+}
+
+// startKeepalive sends a ping on KeepaliveInterval until the returned func is called.
+func (gqc *GQLClient) startKeepalive() func() {
+	if gqc.KeepaliveInterval <= 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
 	go func() {
-		defer close(channel)
-		defer close(errChan)
+		ticker := time.NewTicker(gqc.KeepaliveInterval)
+		defer ticker.Stop()
 		for {
-			msg, err := gqc.ReadIncomingPayload()
-			if err != nil {
-				errChan <- err
+			select {
+			case <-ticker.C:
+				_ = gqc.WriteOperationPacket(&OperationMessage{Type: pingMsg})
+			case <-stop:
+				return
 			}
-			fmt.Println("got smth")
-			if msg.Type == "error" {
-				var errs []*ErrorMessage
-				err = json.Unmarshal(*msg.Payload, &errs)
-				fmt.Println(errs[0].Message)
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// pump reads frames off the current connection until it errors out or ctx is cancelled.
+func (gqc *GQLClient) pump(channel chan<- *IncomingPayload, errChan chan<- error) error {
+	for {
+		msg, err := gqc.ReadIncomingPayload()
+		if err != nil {
+			return err
+		}
+
+		if msg.Type == errorMsg {
+			var errs []*ErrorMessage
+			if err := json.Unmarshal(*msg.Payload, &errs); err != nil {
+				gqc.Logger.Printf("gqlclient: failed to decode error frame for %s: %v", msg.ID, err)
+			} else {
+				gqc.postErr(errChan, &GraphQLError{SubID: msg.ID, Errors: errs})
 			}
-			fmt.Println(msg.ID)
+			continue
+		}
+		if msg.Type == pingMsg {
+			_ = gqc.WriteOperationPacket(&OperationMessage{Type: pongMsg})
+			continue
+		}
+		if msg.Type == kaMsg {
+			continue
+		}
 
-			channel <- msg
+		select {
+		case channel <- msg:
+		case <-gqc.ctx.Done():
+			return gqc.ctx.Err()
+		}
+	}
+}
+
+// Connect dials the core server and runs a supervisor goroutine that keeps
+// the connection alive, reconnecting with backoff and replaying active
+// subscriptions. Cancel ctx to tear the connection down. The returned channel
+// is buffered and posted to non-blockingly, like StateChan.
+func (gqc *GQLClient) Connect(ctx context.Context) <-chan error {
+	gqc.ctx, gqc.cancel = context.WithCancel(ctx)
+
+	packets := make(chan *IncomingPayload)
+	errChan := make(chan error, 8)
 
+	go gqc.demux(packets)
+	go gqc.supervise(packets, errChan)
+
+	return errChan
+}
+
+func (gqc *GQLClient) supervise(channel chan *IncomingPayload, errChan chan error) {
+	defer close(channel)
+	defer close(errChan)
+	defer gqc.setState(StateDisconnected)
+
+	backoff := gqc.MinBackoff
+
+	for gqc.ctx.Err() == nil {
+		gqc.setState(StateConnecting)
+		if err := gqc.dial(); err != nil {
+			gqc.postErr(errChan, err)
+			if !gqc.sleepBackoff(&backoff) {
+				return
+			}
+			continue
 		}
-	}()
 
-	return channel, errChan
+		gqc.setState(StateConnected)
+		backoff = gqc.MinBackoff
+		gqc.replaySubscriptions()
+
+		// Close the connection on cancellation so pump's blocked read returns.
+		pumpDone := make(chan struct{})
+		go func() {
+			select {
+			case <-gqc.ctx.Done():
+				_ = gqc.closeConn()
+			case <-pumpDone:
+			}
+		}()
+
+		stopKeepalive := gqc.startKeepalive()
+		err := gqc.pump(channel, errChan)
+		stopKeepalive()
+		close(pumpDone)
+		_ = gqc.closeConn()
+
+		if gqc.ctx.Err() != nil {
+			return
+		}
+
+		gqc.postErr(errChan, err)
+		gqc.setState(StateReconnecting)
+		if !gqc.sleepBackoff(&backoff) {
+			return
+		}
+	}
 }
 
 type ConfigurationField struct {